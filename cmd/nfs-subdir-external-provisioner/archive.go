@@ -0,0 +1,339 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	archivePrefix            = "archived-"
+	archiveMetaSuffix        = ".archive-meta.json"
+	defaultArchiveGCInterval = time.Hour
+)
+
+var archiveGCDeletedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "nfs_provisioner_archive_gc_deleted_total",
+	Help: "Total number of archived directories removed by the archive GC.",
+})
+
+// defaultArchiveRestoreCapacity is reported on a restored PV's manifest when its original
+// capacity can't be recovered, e.g. an archived-* directory with no archive-meta.json sidecar.
+// It is a placeholder only; operators should edit the manifest's capacity before applying it.
+var defaultArchiveRestoreCapacity = resource.MustParse("1Gi")
+
+func init() {
+	prometheus.MustRegister(archiveGCDeletedTotal)
+}
+
+// archiveMeta is written next to an archived directory at archive time so the GC (and the
+// `archive list`/`archive restore` CLI) can recover the StorageClass's retention settings, and
+// the PV's original backend-specific PersistentVolumeSource, after the PV object that carried
+// them has been deleted from the API server. Keeping the whole source (rather than a
+// backend-specific subset of it) means restore works the same way regardless of which Backend
+// provisioned the directory.
+type archiveMeta struct {
+	StorageClassName string                    `json:"storageClassName"`
+	ArchivedAt       time.Time                 `json:"archivedAt"`
+	Retention        string                    `json:"retention,omitempty"`
+	MaxBytes         int64                     `json:"maxBytes,omitempty"`
+	Source           v1.PersistentVolumeSource `json:"source"`
+	Capacity         resource.Quantity         `json:"capacity"`
+}
+
+func archiveMetaPath(archivePath string) string {
+	return archivePath + archiveMetaSuffix
+}
+
+// writeArchiveMeta records the StorageClass GC settings and the PV's source and capacity in
+// effect at archive time, so they survive the StorageClass (or the PV) being deleted later.
+func writeArchiveMeta(archivePath string, sc *storage.StorageClass, source v1.PersistentVolumeSource, capacity resource.Quantity) error {
+	meta := archiveMeta{
+		StorageClassName: sc.Name,
+		ArchivedAt:       time.Now(),
+		Retention:        sc.Parameters["archiveRetention"],
+		Source:           source,
+		Capacity:         capacity,
+	}
+	if maxBytes := sc.Parameters["archiveMaxBytes"]; maxBytes != "" {
+		if v, err := strconv.ParseInt(maxBytes, 10, 64); err == nil {
+			meta.MaxBytes = v
+		}
+	}
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("unable to marshal archive metadata: %v", err)
+	}
+	return os.WriteFile(archiveMetaPath(archivePath), b, 0o600)
+}
+
+func readArchiveMeta(archivePath string) (*archiveMeta, error) {
+	b, err := os.ReadFile(archiveMetaPath(archivePath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &archiveMeta{}
+	if err := json.Unmarshal(b, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// runArchiveGC periodically deletes archived directories whose StorageClass's archiveRetention
+// has elapsed, and then enforces archiveMaxBytes per StorageClass by deleting the oldest
+// remaining archives first. defaultRetention is applied by directory mtime to archives that have
+// no archive-meta.json sidecar (e.g. one predating this feature, or one whose metadata write
+// failed), so those don't accumulate forever just because their StorageClass settings are
+// unknown; pass 0 to leave them alone, as before. It never stops; call it in its own goroutine.
+func runArchiveGC(interval, defaultRetention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		archiveGCOnce(defaultRetention)
+	}
+}
+
+type archiveEntry struct {
+	path  string
+	name  string
+	size  int64
+	mtime time.Time
+	meta  *archiveMeta
+}
+
+func archiveGCOnce(defaultRetention time.Duration) {
+	entries, err := listArchives()
+	if err != nil {
+		glog.Errorf("archive gc: unable to list archives: %v", err)
+		return
+	}
+
+	byClass := map[string][]*archiveEntry{}
+	for _, e := range entries {
+		if e.meta == nil {
+			if defaultRetention > 0 && time.Since(e.mtime) > defaultRetention {
+				glog.V(4).Infof("archive gc: %s has no archive metadata, applying default retention by mtime", e.name)
+				deleteArchive(e)
+			} else {
+				glog.V(4).Infof("archive gc: %s has no archive metadata, skipping archiveMaxBytes cap enforcement", e.name)
+			}
+			continue
+		}
+		if e.meta.Retention != "" {
+			retention, err := time.ParseDuration(e.meta.Retention)
+			if err != nil {
+				glog.Warningf("archive gc: invalid archiveRetention %q on %s: %v", e.meta.Retention, e.name, err)
+			} else if time.Since(e.meta.ArchivedAt) > retention {
+				deleteArchive(e)
+				continue
+			}
+		}
+		byClass[e.meta.StorageClassName] = append(byClass[e.meta.StorageClassName], e)
+	}
+
+	for _, classEntries := range byClass {
+		maxBytes := int64(0)
+		for _, e := range classEntries {
+			if e.meta.MaxBytes > maxBytes {
+				maxBytes = e.meta.MaxBytes
+			}
+		}
+		if maxBytes == 0 {
+			continue
+		}
+		sort.Slice(classEntries, func(i, j int) bool { return classEntries[i].mtime.Before(classEntries[j].mtime) })
+		var total int64
+		for _, e := range classEntries {
+			total += e.size
+		}
+		for _, e := range classEntries {
+			if total <= maxBytes {
+				break
+			}
+			total -= e.size
+			deleteArchive(e)
+		}
+	}
+}
+
+func deleteArchive(e *archiveEntry) {
+	if err := os.RemoveAll(e.path); err != nil {
+		glog.Errorf("archive gc: unable to delete %s: %v", e.path, err)
+		return
+	}
+	os.Remove(archiveMetaPath(e.path))
+	glog.Infof("archive gc: deleted %s", e.name)
+	archiveGCDeletedTotal.Inc()
+}
+
+// listArchives returns every archived-* directory directly under mountPath.
+func listArchives() ([]*archiveEntry, error) {
+	dirEntries, err := os.ReadDir(mountPath)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*archiveEntry
+	for _, de := range dirEntries {
+		if !de.IsDir() || !strings.HasPrefix(de.Name(), archivePrefix) {
+			continue
+		}
+		fullPath := filepath.Join(mountPath, de.Name())
+		size, err := dirSize(fullPath)
+		if err != nil {
+			glog.Warningf("archive gc: unable to size %s: %v", fullPath, err)
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			glog.Warningf("archive gc: unable to stat %s: %v", fullPath, err)
+			continue
+		}
+		meta, err := readArchiveMeta(fullPath)
+		if err != nil {
+			glog.Warningf("archive gc: unable to read archive metadata for %s: %v", fullPath, err)
+		}
+		entries = append(entries, &archiveEntry{
+			path:  fullPath,
+			name:  de.Name(),
+			size:  size,
+			mtime: info.ModTime(),
+			meta:  meta,
+		})
+	}
+	return entries, nil
+}
+
+func dirSize(path string) (int64, error) {
+	bytes, _, err := duUsage(path)
+	return bytes, err
+}
+
+// runArchiveCLI implements the `archive list|restore <name>` operator subcommand.
+func runArchiveCLI(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: nfs-provisioner archive list|restore <name>")
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "list":
+		archiveListCmd()
+	case "restore":
+		if len(args) != 2 {
+			fmt.Fprintln(os.Stderr, "usage: nfs-provisioner archive restore <name>")
+			os.Exit(2)
+		}
+		archiveRestoreCmd(args[1])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown archive subcommand %q\n", args[0])
+		os.Exit(2)
+	}
+}
+
+func archiveListCmd() {
+	entries, err := listArchives()
+	if err != nil {
+		glog.Fatalf("unable to list archives: %v", err)
+	}
+	fmt.Printf("%-48s %-12s %-24s %s\n", "NAME", "SIZE", "ARCHIVED AT", "STORAGECLASS")
+	for _, e := range entries {
+		archivedAt := "unknown"
+		storageClassName := "unknown"
+		if e.meta != nil {
+			archivedAt = e.meta.ArchivedAt.Format(time.RFC3339)
+			storageClassName = e.meta.StorageClassName
+		}
+		fmt.Printf("%-48s %-12d %-24s %s\n", e.name, e.size, archivedAt, storageClassName)
+	}
+}
+
+func archiveRestoreCmd(name string) {
+	archivePath := filepath.Join(mountPath, archivePrefix+name)
+	if _, err := os.Stat(archivePath); err != nil {
+		glog.Fatalf("archive %s not found: %v", name, err)
+	}
+	meta, err := readArchiveMeta(archivePath)
+	if err != nil {
+		glog.Warningf("unable to read archive metadata for %s: %v", name, err)
+	}
+
+	restoredPath := filepath.Join(mountPath, name)
+	if err := os.Rename(archivePath, restoredPath); err != nil {
+		glog.Fatalf("unable to restore %s: %v", name, err)
+	}
+	os.Remove(archiveMetaPath(archivePath))
+
+	storageClassName := ""
+	var source v1.PersistentVolumeSource
+	capacity := defaultArchiveRestoreCapacity
+	if meta != nil {
+		storageClassName = meta.StorageClassName
+		source = meta.Source
+		if !meta.Capacity.IsZero() {
+			capacity = meta.Capacity
+		}
+	} else {
+		// No archive metadata (e.g. an archived-* directory predating this feature, or one
+		// whose metadata write failed): fall back to reconstructing the source from the
+		// current backend configuration, the same way Provision would have built it, and to
+		// defaultArchiveRestoreCapacity since the original capacity can no longer be known.
+		glog.Warningf("no archive metadata for %s, reconstructing volume source from the current backend", name)
+		backend, err := backendFromEnv()
+		if err != nil {
+			glog.Fatalf("unable to configure backend to reconstruct volume source: %v", err)
+		}
+		source = backend.BuildVolumeSource(name, &storage.StorageClass{})
+	}
+
+	pv := &v1.PersistentVolume{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PersistentVolume"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PersistentVolumeSpec{
+			StorageClassName: storageClassName,
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteMany},
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: capacity,
+			},
+			PersistentVolumeSource: source,
+		},
+	}
+	b, err := yaml.Marshal(pv)
+	if err != nil {
+		glog.Fatalf("unable to render restored PV manifest for %s: %v", name, err)
+	}
+	fmt.Print(string(b))
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+)
+
+// Backend abstracts away the kind of share a provisioned directory is published on, so the
+// rest of the provisioner (path templating, gid allocation, quotas, metrics, archiving) stays
+// share-type agnostic.
+type Backend interface {
+	// Mountpoint is the local filesystem path under which this backend's storage is mounted
+	// inside the provisioner container. All provisioned directories live under it.
+	Mountpoint() string
+	// BuildVolumeSource returns the PersistentVolumeSource a PV should use to reference the
+	// directory at path (relative to Mountpoint), for the given StorageClass.
+	BuildVolumeSource(path string, sc *storage.StorageClass) v1.PersistentVolumeSource
+	// Validate returns an error if sc isn't usable by this backend, e.g. a required parameter
+	// is missing.
+	Validate(sc *storage.StorageClass) error
+	// LocalPath is the inverse of BuildVolumeSource: given a PV's source, it returns the full
+	// local path, under Mountpoint, of the directory on disk backing it. Delete, Resize, the
+	// quota reconciler and the metrics collector use it to find a provisioned directory
+	// without knowing which backend created it.
+	LocalPath(source v1.PersistentVolumeSource) (string, error)
+}
+
+// backendFromEnv constructs the Backend selected by the BACKEND_TYPE environment variable,
+// defaulting to "nfs" to preserve existing deployments' behavior.
+func backendFromEnv() (Backend, error) {
+	switch backendType := os.Getenv("BACKEND_TYPE"); backendType {
+	case "", "nfs":
+		server := os.Getenv("NFS_SERVER")
+		if server == "" {
+			return nil, fmt.Errorf("NFS_SERVER not set")
+		}
+		path := os.Getenv("NFS_PATH")
+		if path == "" {
+			return nil, fmt.Errorf("NFS_PATH not set")
+		}
+		return newNFSBackend(server, path), nil
+	case "cifs":
+		return newCIFSBackend()
+	case "hostpath":
+		return hostPathBackend{}, nil
+	default:
+		return nil, fmt.Errorf("unknown BACKEND_TYPE %q", backendType)
+	}
+}
+
+// nfsBackend is the original, and still default, backend: it publishes provisioned directories
+// as plain NFSVolumeSources.
+type nfsBackend struct {
+	server     string
+	remotePath string
+}
+
+func newNFSBackend(server, remotePath string) *nfsBackend {
+	return &nfsBackend{server: server, remotePath: remotePath}
+}
+
+func (b *nfsBackend) Mountpoint() string { return mountPath }
+
+func (b *nfsBackend) Validate(sc *storage.StorageClass) error { return nil }
+
+func (b *nfsBackend) BuildVolumeSource(path string, sc *storage.StorageClass) v1.PersistentVolumeSource {
+	return v1.PersistentVolumeSource{
+		NFS: &v1.NFSVolumeSource{
+			Server:   b.server,
+			Path:     filepath.Join(b.remotePath, path),
+			ReadOnly: false,
+		},
+	}
+}
+
+func (b *nfsBackend) LocalPath(source v1.PersistentVolumeSource) (string, error) {
+	if source.NFS == nil {
+		return "", fmt.Errorf("volume has no NFS source")
+	}
+	if !strings.HasPrefix(source.NFS.Path, b.remotePath) {
+		return "", fmt.Errorf("nfs path %s is not under %s", source.NFS.Path, b.remotePath)
+	}
+	return filepath.Join(mountPath, strings.TrimPrefix(source.NFS.Path, b.remotePath)), nil
+}
+
+// cifsBackend publishes provisioned directories as CSI PersistentVolumeSources served by the
+// smb.csi.k8s.io CSI driver, for clusters that need SMB/CIFS shares instead of NFS.
+type cifsBackend struct {
+	server          string
+	share           string
+	remotePath      string
+	secretName      string
+	secretNamespace string
+}
+
+func newCIFSBackend() (*cifsBackend, error) {
+	server := os.Getenv("CIFS_SERVER")
+	share := os.Getenv("CIFS_SHARE")
+	if server == "" || share == "" {
+		return nil, fmt.Errorf("CIFS_SERVER and CIFS_SHARE must be set for the cifs backend")
+	}
+	return &cifsBackend{
+		server:          server,
+		share:           share,
+		remotePath:      os.Getenv("CIFS_PATH"),
+		secretName:      os.Getenv("CIFS_SECRET_NAME"),
+		secretNamespace: os.Getenv("CIFS_SECRET_NAMESPACE"),
+	}, nil
+}
+
+func (b *cifsBackend) Mountpoint() string { return mountPath }
+
+func (b *cifsBackend) Validate(sc *storage.StorageClass) error {
+	if sc.Parameters["secretName"] == "" && b.secretName == "" {
+		return fmt.Errorf("storage class %s must set a secretName parameter for the cifs backend", sc.Name)
+	}
+	return nil
+}
+
+func (b *cifsBackend) source(path string) string {
+	return filepath.Join(b.share, b.remotePath, path)
+}
+
+func (b *cifsBackend) BuildVolumeSource(path string, sc *storage.StorageClass) v1.PersistentVolumeSource {
+	secretName := sc.Parameters["secretName"]
+	if secretName == "" {
+		secretName = b.secretName
+	}
+	secretNamespace := sc.Parameters["secretNamespace"]
+	if secretNamespace == "" {
+		secretNamespace = b.secretNamespace
+	}
+	source := b.source(path)
+	return v1.PersistentVolumeSource{
+		CSI: &v1.CSIPersistentVolumeSource{
+			Driver:       "smb.csi.k8s.io",
+			VolumeHandle: strings.ReplaceAll(source, "/", "-"),
+			ReadOnly:     false,
+			VolumeAttributes: map[string]string{
+				"source": fmt.Sprintf("//%s/%s", b.server, source),
+			},
+			NodeStageSecretRef: &v1.SecretReference{
+				Name:      secretName,
+				Namespace: secretNamespace,
+			},
+		},
+	}
+}
+
+func (b *cifsBackend) LocalPath(source v1.PersistentVolumeSource) (string, error) {
+	if source.CSI == nil {
+		return "", fmt.Errorf("volume has no CSI source")
+	}
+	prefix := fmt.Sprintf("//%s/%s", b.server, filepath.Join(b.share, b.remotePath))
+	src := source.CSI.VolumeAttributes["source"]
+	if !strings.HasPrefix(src, prefix) {
+		return "", fmt.Errorf("cifs source %s is not under %s", src, prefix)
+	}
+	return filepath.Join(mountPath, strings.TrimPrefix(src, prefix)), nil
+}
+
+// hostPathBackend publishes provisioned directories as node-local HostPath volumes, for
+// single-node / local-path scenarios that don't need a shared filesystem at all.
+type hostPathBackend struct{}
+
+func (hostPathBackend) Mountpoint() string { return mountPath }
+
+func (hostPathBackend) Validate(sc *storage.StorageClass) error { return nil }
+
+func (hostPathBackend) BuildVolumeSource(path string, sc *storage.StorageClass) v1.PersistentVolumeSource {
+	return v1.PersistentVolumeSource{
+		HostPath: &v1.HostPathVolumeSource{
+			Path: filepath.Join(mountPath, path),
+		},
+	}
+}
+
+func (hostPathBackend) LocalPath(source v1.PersistentVolumeSource) (string, error) {
+	if source.HostPath == nil {
+		return "", fmt.Errorf("volume has no HostPath source")
+	}
+	return source.HostPath.Path, nil
+}
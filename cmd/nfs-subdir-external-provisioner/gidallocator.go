@@ -0,0 +1,185 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// provisionedByAnnotation is stamped by the external-provisioner sig-storage-lib on every
+	// PV it creates, naming the provisioner that owns it.
+	provisionedByAnnotation = "pv.kubernetes.io/provisioned-by"
+	// nfsProvisionedGidAnnotation records the GID leased from a StorageClass's gid range so
+	// that Delete can return it to the pool.
+	nfsProvisionedGidAnnotation = "volume.kubernetes.io/nfs-provisioned-gid"
+
+	defaultGidMin = 2000
+	defaultGidMax = 2147483647
+)
+
+// gidRange tracks the leased GIDs for a single StorageClass.
+type gidRange struct {
+	min, max int
+	used     map[int]bool
+}
+
+func (r *gidRange) allocate() (int, error) {
+	for gid := r.min; gid <= r.max; gid++ {
+		if !r.used[gid] {
+			r.used[gid] = true
+			return gid, nil
+		}
+	}
+	return 0, fmt.Errorf("no available gid in range [%d, %d]", r.min, r.max)
+}
+
+func (r *gidRange) release(gid int) {
+	delete(r.used, gid)
+}
+
+// gidAllocator leases unique GIDs out of a per-StorageClass range, so directories provisioned
+// for that class can be made group-writable via supplementalGroups without colliding with
+// directories provisioned for another class. State is rebuilt on demand by scanning the PVs
+// this provisioner already created, so it survives provisioner restarts without its own store.
+type gidAllocator struct {
+	client          kubernetes.Interface
+	provisionerName string
+
+	mutex  sync.Mutex
+	ranges map[string]*gidRange
+}
+
+func newGidAllocator(client kubernetes.Interface, provisionerName string) *gidAllocator {
+	return &gidAllocator{
+		client:          client,
+		provisionerName: provisionerName,
+		ranges:          map[string]*gidRange{},
+	}
+}
+
+// gidAllocationEnabled returns whether GID allocation is enabled for the StorageClass. It is on
+// by default; a class opts out with `gidAllocate: "false"`.
+func gidAllocationEnabled(sc *storage.StorageClass) bool {
+	return sc.Parameters["gidAllocate"] != "false"
+}
+
+// rangeFor returns the gidRange for the given StorageClass, scanning existing PVs to rebuild
+// its used-GID bitmap the first time the class is seen. Callers must hold a.mutex.
+func (a *gidAllocator) rangeFor(ctx context.Context, sc *storage.StorageClass) (*gidRange, error) {
+	if r, ok := a.ranges[sc.Name]; ok {
+		return r, nil
+	}
+
+	min, err := parseGidParam(sc.Parameters["gidMin"], defaultGidMin)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gidMin: %v", err)
+	}
+	max, err := parseGidParam(sc.Parameters["gidMax"], defaultGidMax)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gidMax: %v", err)
+	}
+	if min > max {
+		return nil, fmt.Errorf("gidMin %d is greater than gidMax %d", min, max)
+	}
+
+	r := &gidRange{min: min, max: max, used: map[int]bool{}}
+	if err := a.scanUsedGids(ctx, sc.Name, r); err != nil {
+		return nil, err
+	}
+	a.ranges[sc.Name] = r
+	return r, nil
+}
+
+// scanUsedGids lists PVs provisioned by this provisioner for the given StorageClass and marks
+// their leased GIDs as used, so a restarted provisioner picks up where the last one left off.
+func (a *gidAllocator) scanUsedGids(ctx context.Context, storageClassName string, r *gidRange) error {
+	pvs, err := a.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list PVs to rebuild gid allocations: %v", err)
+	}
+	for _, pv := range pvs.Items {
+		if pv.Annotations[provisionedByAnnotation] != a.provisionerName {
+			continue
+		}
+		if pv.Spec.StorageClassName != storageClassName {
+			continue
+		}
+		gidStr, ok := pv.Annotations[nfsProvisionedGidAnnotation]
+		if !ok {
+			continue
+		}
+		gid, err := strconv.Atoi(gidStr)
+		if err != nil {
+			glog.Warningf("pv %s has unparsable %s annotation %q: %v", pv.Name, nfsProvisionedGidAnnotation, gidStr, err)
+			continue
+		}
+		r.used[gid] = true
+	}
+	return nil
+}
+
+// Allocate leases the next free GID for the given StorageClass.
+func (a *gidAllocator) Allocate(ctx context.Context, sc *storage.StorageClass) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	r, err := a.rangeFor(ctx, sc)
+	if err != nil {
+		return 0, err
+	}
+	return r.allocate()
+}
+
+// Release returns the GID recorded on pv's nfsProvisionedGidAnnotation to the pool for its
+// StorageClass, if any. It is a no-op for PVs that never had a GID allocated.
+func (a *gidAllocator) Release(ctx context.Context, sc *storage.StorageClass, pv *v1.PersistentVolume) error {
+	gidStr, ok := pv.Annotations[nfsProvisionedGidAnnotation]
+	if !ok {
+		return nil
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("invalid %s annotation %q on pv %s: %v", nfsProvisionedGidAnnotation, gidStr, pv.Name, err)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	r, err := a.rangeFor(ctx, sc)
+	if err != nil {
+		return err
+	}
+	r.release(gid)
+	return nil
+}
+
+func parseGidParam(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
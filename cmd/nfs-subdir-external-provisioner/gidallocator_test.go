@@ -0,0 +1,167 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storage "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGidRangeAllocateRelease(t *testing.T) {
+	r := &gidRange{min: 2000, max: 2001, used: map[int]bool{}}
+
+	first, err := r.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if first != 2000 {
+		t.Fatalf("expected first allocation to be gidMin 2000, got %d", first)
+	}
+
+	second, err := r.allocate()
+	if err != nil {
+		t.Fatalf("allocate: %v", err)
+	}
+	if second != 2001 {
+		t.Fatalf("expected second allocation to be 2001, got %d", second)
+	}
+
+	if _, err := r.allocate(); err == nil {
+		t.Fatal("expected allocate to fail once the range is exhausted")
+	}
+
+	r.release(first)
+	third, err := r.allocate()
+	if err != nil {
+		t.Fatalf("allocate after release: %v", err)
+	}
+	if third != first {
+		t.Fatalf("expected released gid %d to be reused, got %d", first, third)
+	}
+}
+
+func TestGidAllocationEnabled(t *testing.T) {
+	cases := []struct {
+		name   string
+		params map[string]string
+		want   bool
+	}{
+		{name: "unset defaults to enabled", params: nil, want: true},
+		{name: "explicit false disables", params: map[string]string{"gidAllocate": "false"}, want: false},
+		{name: "other value stays enabled", params: map[string]string{"gidAllocate": "true"}, want: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := &storage.StorageClass{Parameters: c.params}
+			if got := gidAllocationEnabled(sc); got != c.want {
+				t.Errorf("gidAllocationEnabled(%v) = %v, want %v", c.params, got, c.want)
+			}
+		})
+	}
+}
+
+func TestParseGidParam(t *testing.T) {
+	if v, err := parseGidParam("", 2000); err != nil || v != 2000 {
+		t.Fatalf("parseGidParam(\"\", 2000) = %d, %v; want 2000, nil", v, err)
+	}
+	if v, err := parseGidParam("3000", 2000); err != nil || v != 3000 {
+		t.Fatalf("parseGidParam(\"3000\", 2000) = %d, %v; want 3000, nil", v, err)
+	}
+	if _, err := parseGidParam("not-a-number", 2000); err == nil {
+		t.Fatal("expected parseGidParam to reject a non-numeric value")
+	}
+}
+
+func TestGidAllocatorAllocateRelease(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := newGidAllocator(client, "example.com/nfs")
+	sc := &storage.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "sc1"},
+		Parameters: map[string]string{"gidMin": "2000", "gidMax": "2000"},
+	}
+	ctx := context.Background()
+
+	gid, err := a.Allocate(ctx, sc)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if gid != 2000 {
+		t.Fatalf("expected gid 2000, got %d", gid)
+	}
+
+	if _, err := a.Allocate(ctx, sc); err == nil {
+		t.Fatal("expected a second Allocate on an exhausted range to fail")
+	}
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "pv1",
+			Annotations: map[string]string{nfsProvisionedGidAnnotation: "2000"},
+		},
+		Spec: v1.PersistentVolumeSpec{StorageClassName: sc.Name},
+	}
+	if err := a.Release(ctx, sc, pv); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	if _, err := a.Allocate(ctx, sc); err != nil {
+		t.Fatalf("Allocate after Release: %v", err)
+	}
+}
+
+func TestGidAllocatorReleaseWithoutAnnotationIsNoop(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	a := newGidAllocator(client, "example.com/nfs")
+	sc := &storage.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "sc1"}}
+	pv := &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv1"}}
+
+	if err := a.Release(context.Background(), sc, pv); err != nil {
+		t.Fatalf("Release on a pv with no gid annotation should be a no-op, got: %v", err)
+	}
+}
+
+func TestGidAllocatorRebuildsUsedGidsFromExistingPVs(t *testing.T) {
+	sc := &storage.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "sc1"},
+		Parameters: map[string]string{"gidMin": "2000", "gidMax": "2001"},
+	}
+	existing := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "pv1",
+			Annotations: map[string]string{
+				provisionedByAnnotation:     "example.com/nfs",
+				nfsProvisionedGidAnnotation: "2000",
+			},
+		},
+		Spec: v1.PersistentVolumeSpec{StorageClassName: sc.Name},
+	}
+	client := fake.NewSimpleClientset(existing)
+	a := newGidAllocator(client, "example.com/nfs")
+
+	gid, err := a.Allocate(context.Background(), sc)
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	if gid != 2001 {
+		t.Fatalf("expected allocator to skip the gid already used by an existing PV, got %d", gid)
+	}
+}
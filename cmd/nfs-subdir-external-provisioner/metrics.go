@@ -0,0 +1,244 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	storagehelpers "k8s.io/component-helpers/storage/volume"
+)
+
+const (
+	defaultMetricsScanInterval = 5 * time.Minute
+	defaultMetricsConcurrency  = 4
+	defaultMetricsPort         = "8080"
+)
+
+var (
+	volumeUsedBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_volume_used_bytes",
+		Help: "Bytes used in a provisioned volume's directory tree.",
+	}, []string{"pv", "pvc_namespace", "pvc_name", "storageclass"})
+
+	volumeInodesUsed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_volume_inodes_used",
+		Help: "Inodes used in a provisioned volume's directory tree.",
+	}, []string{"pv", "pvc_namespace", "pvc_name", "storageclass"})
+
+	volumeCapacityBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nfs_provisioner_volume_capacity_bytes",
+		Help: "Capacity requested for a provisioned volume, as recorded on its PV.",
+	}, []string{"pv", "pvc_namespace", "pvc_name", "storageclass"})
+
+	provisionTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nfs_provisioner_provision_total",
+		Help: "Total number of volume provision attempts.",
+	}, []string{"result"})
+
+	deleteTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nfs_provisioner_delete_total",
+		Help: "Total number of volume delete attempts.",
+	})
+
+	archiveTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nfs_provisioner_archive_total",
+		Help: "Total number of volumes archived instead of deleted.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(volumeUsedBytes, volumeInodesUsed, volumeCapacityBytes, provisionTotal, deleteTotal, archiveTotal)
+}
+
+// metricsCollector walks the directories this provisioner owns and reports their disk usage as
+// Prometheus gauges, the way the in-tree kubelet volume plugins do via volume/metrics_du.go.
+type metricsCollector struct {
+	client          kubernetes.Interface
+	provisionerName string
+	backend         Backend
+	scanInterval    time.Duration
+	concurrency     int
+
+	queue    workqueue.RateLimitingInterface
+	informer cache.SharedIndexInformer
+}
+
+func newMetricsCollector(client kubernetes.Interface, provisionerName string, backend Backend, scanInterval time.Duration, concurrency int) *metricsCollector {
+	return &metricsCollector{
+		client:          client,
+		provisionerName: provisionerName,
+		backend:         backend,
+		scanInterval:    scanInterval,
+		concurrency:     concurrency,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+// Run starts the PV informer and the worker pool that reconciles usage metrics against it. It
+// blocks until ctx is done.
+func (c *metricsCollector) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(c.client, c.scanInterval)
+	c.informer = factory.Core().V1().PersistentVolumes().Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			if pv, ok := obj.(*v1.PersistentVolume); ok {
+				c.clearMetrics(pv)
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	for i := 0; i < c.concurrency; i++ {
+		go c.runWorker(ctx)
+	}
+
+	ticker := time.NewTicker(c.scanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.queue.ShutDown()
+			return
+		case <-ticker.C:
+			c.enqueueAll()
+		}
+	}
+}
+
+func (c *metricsCollector) enqueue(obj interface{}) {
+	pv, ok := obj.(*v1.PersistentVolume)
+	if !ok || pv.Annotations[provisionedByAnnotation] != c.provisionerName {
+		return
+	}
+	c.queue.Add(pv.Name)
+}
+
+func (c *metricsCollector) enqueueAll() {
+	for _, obj := range c.informer.GetStore().List() {
+		c.enqueue(obj)
+	}
+}
+
+func (c *metricsCollector) runWorker(ctx context.Context) {
+	for c.processNextItem() {
+	}
+}
+
+func (c *metricsCollector) processNextItem() bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(key.(string)); err != nil {
+		glog.Errorf("metrics: unable to collect usage for pv %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *metricsCollector) sync(pvName string) error {
+	obj, exists, err := c.informer.GetStore().GetByKey(pvName)
+	if err != nil || !exists {
+		return err
+	}
+	pv := obj.(*v1.PersistentVolume)
+	path, err := c.backend.LocalPath(pv.Spec.PersistentVolumeSource)
+	if err != nil {
+		return nil
+	}
+
+	labels := c.labelsFor(pv)
+	usedBytes, inodes, err := duUsage(path)
+	if err != nil {
+		return err
+	}
+	volumeUsedBytes.With(labels).Set(float64(usedBytes))
+	volumeInodesUsed.With(labels).Set(float64(inodes))
+	if capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok {
+		volumeCapacityBytes.With(labels).Set(float64(capacity.Value()))
+	}
+	return nil
+}
+
+func (c *metricsCollector) clearMetrics(pv *v1.PersistentVolume) {
+	labels := c.labelsFor(pv)
+	volumeUsedBytes.Delete(labels)
+	volumeInodesUsed.Delete(labels)
+	volumeCapacityBytes.Delete(labels)
+}
+
+func (c *metricsCollector) labelsFor(pv *v1.PersistentVolume) prometheus.Labels {
+	var pvcNamespace, pvcName string
+	if pv.Spec.ClaimRef != nil {
+		pvcNamespace = pv.Spec.ClaimRef.Namespace
+		pvcName = pv.Spec.ClaimRef.Name
+	}
+	return prometheus.Labels{
+		"pv":            pv.Name,
+		"pvc_namespace": pvcNamespace,
+		"pvc_name":      pvcName,
+		"storageclass":  storagehelpers.GetPersistentVolumeClass(pv),
+	}
+}
+
+// duUsage walks path and sums file sizes and inode counts, mirroring the approach of
+// Kubernetes' in-tree volume/metrics_du.go.
+func duUsage(path string) (bytes int64, inodes int64, err error) {
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		bytes += info.Size()
+		inodes++
+		return nil
+	})
+	return bytes, inodes, err
+}
+
+// startMetricsServer serves /metrics and /healthz on addr until the process exits.
+func startMetricsServer(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			glog.Errorf("metrics server exited: %v", err)
+		}
+	}()
+}
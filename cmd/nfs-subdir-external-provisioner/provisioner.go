@@ -26,11 +26,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	v1 "k8s.io/api/core/v1"
 
 	storage "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -43,37 +45,18 @@ const (
 	provisionerNameKey = "PROVISIONER_NAME"
 )
 
-type nfsProvisioner struct {
-	client      kubernetes.Interface
-	server      string
-	path        string
-	defaultMode os.FileMode
-	defaultUid  int
-	defaultGid  int
-}
-
-type pvcMetadata struct {
-	data        map[string]string
-	labels      map[string]string
-	annotations map[string]string
-}
-
-var pattern = regexp.MustCompile(`\${\.PVC\.((labels|annotations)\.(.*?)|.*?)}`)
-
-func (meta *pvcMetadata) stringParser(str string) string {
-	result := pattern.FindAllStringSubmatch(str, -1)
-	for _, r := range result {
-		switch r[2] {
-		case "labels":
-			str = strings.ReplaceAll(str, r[0], meta.labels[r[3]])
-		case "annotations":
-			str = strings.ReplaceAll(str, r[0], meta.annotations[r[3]])
-		default:
-			str = strings.ReplaceAll(str, r[0], meta.data[r[1]])
-		}
-	}
-
-	return str
+// subdirProvisioner provisions PVs by creating subdirectories of a shared filesystem and handing
+// them out, the way nfs-client's in-tree predecessor did for NFS. The storage type it hands
+// directories out on - NFS, CIFS/SMB, or a node-local hostPath - is pluggable via backend.
+type subdirProvisioner struct {
+	client          kubernetes.Interface
+	provisionerName string
+	backend         Backend
+	defaultMode     os.FileMode
+	defaultUid      int
+	defaultGid      int
+	gidAllocator    *gidAllocator
+	projectIDIndex  *projectIDIndex
 }
 
 const (
@@ -81,13 +64,24 @@ const (
 	annotationPrefix = "k8s-sigs.io"
 )
 
-var _ controller.Provisioner = &nfsProvisioner{}
+var _ controller.Provisioner = &subdirProvisioner{}
+
+func (p *subdirProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (pv *v1.PersistentVolume, state controller.ProvisioningState, err error) {
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "failure"
+		}
+		provisionTotal.WithLabelValues(result).Inc()
+	}()
 
-func (p *nfsProvisioner) Provision(ctx context.Context, options controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
 	if options.PVC.Spec.Selector != nil {
 		return nil, controller.ProvisioningFinished, fmt.Errorf("claim Selector is not supported")
 	}
-	glog.V(4).Infof("nfs provisioner: VolumeOptions %v", options)
+	if err := p.backend.Validate(options.StorageClass); err != nil {
+		return nil, controller.ProvisioningFinished, fmt.Errorf("storage class not usable by this backend: %v", err)
+	}
+	glog.V(4).Infof("subdir provisioner: VolumeOptions %v", options)
 
 	pvcNamespace := options.PVC.Namespace
 	pvcName := options.PVC.Name
@@ -99,19 +93,41 @@ func (p *nfsProvisioner) Provision(ctx context.Context, options controller.Provi
 			"name":      pvcName,
 			"namespace": pvcNamespace,
 		},
-		labels:      options.PVC.Labels,
-		annotations: options.PVC.Annotations,
+		labels:       options.PVC.Labels,
+		annotations:  options.PVC.Annotations,
+		pvcUID:       string(options.PVC.UID),
+		scName:       options.StorageClass.Name,
+		scParameters: options.StorageClass.Parameters,
+	}
+	if options.SelectedNode != nil {
+		metadata.nodeName = options.SelectedNode.Name
 	}
 
-	fullPath := filepath.Join(mountPath, pvName)
-	path := filepath.Join(p.path, pvName)
+	// relPath is the directory's path relative to the backend's share/mount, i.e. the part the
+	// backend needs to turn into a PersistentVolumeSource. fullPath is where that same directory
+	// lives on the local filesystem the provisioner container has mounted.
+	relPath := pvName
+	fullPath := filepath.Join(p.backend.Mountpoint(), pvName)
 
 	pathPattern, exists := options.StorageClass.Parameters["pathPattern"]
 	if exists {
-		customPath := metadata.stringParser(pathPattern)
+		strict := options.StorageClass.Parameters["pathPatternStrict"] == "true"
+		customPath, err := metadata.stringParser(pathPattern, strict)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("unable to expand pathPattern: %v", err)
+		}
+		if allowlist := options.StorageClass.Parameters["pathPatternAllowlist"]; allowlist != "" && customPath != "" {
+			re, err := regexp.Compile(allowlist)
+			if err != nil {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("invalid pathPatternAllowlist: %v", err)
+			}
+			if !re.MatchString(customPath) {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("expanded path %q does not match pathPatternAllowlist", customPath)
+			}
+		}
 		if customPath != "" {
-			path = filepath.Join(p.path, customPath)
-			fullPath = filepath.Join(mountPath, customPath)
+			relPath = customPath
+			fullPath = filepath.Join(p.backend.Mountpoint(), customPath)
 		}
 	}
 
@@ -129,7 +145,7 @@ func (p *nfsProvisioner) Provision(ctx context.Context, options controller.Provi
 	if err := os.MkdirAll(fullPath, mode); err != nil {
 		return nil, controller.ProvisioningFinished, errors.New("unable to create directory to provision new pv: " + err.Error())
 	}
-	err := os.Chmod(fullPath, mode)
+	err = os.Chmod(fullPath, mode)
 	if err != nil {
 		return nil, "", err
 	}
@@ -159,13 +175,50 @@ func (p *nfsProvisioner) Provision(ctx context.Context, options controller.Provi
 			gid = p.defaultGid
 		}
 	}
+	// Allocate a unique GID from the StorageClass's gid range, unless the class opted out or the
+	// PVC pinned an explicit gid via annotation, so the directory can be made group-writable for
+	// unprivileged pods via supplementalGroups without stomping on an operator-chosen gid.
+	pvAnnotations := map[string]string{}
+	allocateGid := p.gidAllocator != nil && gidAllocationEnabled(options.StorageClass) && pvcGid == ""
+	if allocateGid {
+		allocatedGid, err := p.gidAllocator.Allocate(ctx, options.StorageClass)
+		if err != nil {
+			return nil, controller.ProvisioningFinished, fmt.Errorf("unable to allocate gid: %v", err)
+		}
+		gid = allocatedGid
+		pvAnnotations[nfsProvisionedGidAnnotation] = strconv.Itoa(gid)
+	}
+
 	err = os.Chown(fullPath, uid, gid)
 	if err != nil {
 		return nil, "", err
 	}
-	pv := &v1.PersistentVolume{
+	if allocateGid {
+		if err := os.Chmod(fullPath, mode|os.ModeSetgid); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Enforce the requested size as a filesystem quota, if the StorageClass named a backend.
+	if p.projectIDIndex != nil {
+		quotaBackend := options.StorageClass.Parameters["quotaBackend"]
+		enforcer := quotaEnforcerForBackend(quotaBackend)
+		if _, isNoop := enforcer.(noopQuotaEnforcer); !isNoop {
+			projectID, err := p.projectIDIndex.Assign(fullPath)
+			if err != nil {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("unable to assign project id: %v", err)
+			}
+			requested := options.PVC.Spec.Resources.Requests[v1.ResourceStorage]
+			if err := enforcer.SetQuota(fullPath, projectID, requested.Value()); err != nil {
+				return nil, controller.ProvisioningFinished, fmt.Errorf("unable to set quota: %v", err)
+			}
+		}
+	}
+
+	pv = &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: options.PVName,
+			Name:        options.PVName,
+			Annotations: pvAnnotations,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeReclaimPolicy: *options.StorageClass.ReclaimPolicy,
@@ -174,22 +227,19 @@ func (p *nfsProvisioner) Provision(ctx context.Context, options controller.Provi
 			Capacity: v1.ResourceList{
 				v1.ResourceName(v1.ResourceStorage): options.PVC.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)],
 			},
-			PersistentVolumeSource: v1.PersistentVolumeSource{
-				NFS: &v1.NFSVolumeSource{
-					Server:   p.server,
-					Path:     path,
-					ReadOnly: false,
-				},
-			},
+			PersistentVolumeSource: p.backend.BuildVolumeSource(relPath, options.StorageClass),
 		},
 	}
 	return pv, controller.ProvisioningFinished, nil
 }
 
-func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
-	path := volume.Spec.PersistentVolumeSource.NFS.Path
-	basePath := filepath.Base(path)
-	oldPath := strings.Replace(path, p.path, mountPath, 1)
+func (p *subdirProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume) error {
+	deleteTotal.Inc()
+	oldPath, err := p.backend.LocalPath(volume.Spec.PersistentVolumeSource)
+	if err != nil {
+		return fmt.Errorf("unable to determine local path for volume %s: %v", volume.Name, err)
+	}
+	basePath := filepath.Base(oldPath)
 
 	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
 		glog.Warningf("path %s does not exist, deletion skipped", oldPath)
@@ -201,6 +251,12 @@ func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 		return err
 	}
 
+	if p.gidAllocator != nil && gidAllocationEnabled(storageClass) {
+		if err := p.gidAllocator.Release(ctx, storageClass, volume); err != nil {
+			glog.Warningf("unable to release gid for volume %s: %v", volume.Name, err)
+		}
+	}
+
 	// Determine if the "onDelete" parameter exists.
 	// If it exists and has a `delete` value, delete the directory.
 	// If it exists and has a `retain` value, safe the directory.
@@ -228,11 +284,83 @@ func (p *nfsProvisioner) Delete(ctx context.Context, volume *v1.PersistentVolume
 
 	archivePath := filepath.Join(mountPath, "archived-"+basePath)
 	glog.V(4).Infof("archiving path %s to %s", oldPath, archivePath)
-	return os.Rename(oldPath, archivePath)
+	if err := os.Rename(oldPath, archivePath); err != nil {
+		return err
+	}
+	if err := writeArchiveMeta(archivePath, storageClass, volume.Spec.PersistentVolumeSource, volume.Spec.Capacity[v1.ResourceStorage]); err != nil {
+		glog.Warningf("unable to write archive metadata for %s: %v", archivePath, err)
+	}
+	archiveTotal.Inc()
+	return nil
+}
+
+// Resize raises the quota backing pv to newSize. This out-of-tree provisioner predates CSI and
+// the annotation-based sig-storage-lib controller it's built on has no ControllerExpandVolume
+// callback of its own, so resizeController (see resize.go) watches PVC edits itself and calls
+// this when `allowVolumeExpansion: true` and a `quotaBackend` are configured on the StorageClass.
+func (p *subdirProvisioner) Resize(ctx context.Context, pv *v1.PersistentVolume, newSize resource.Quantity) error {
+	path, err := p.backend.LocalPath(pv.Spec.PersistentVolumeSource)
+	if err != nil {
+		return fmt.Errorf("unable to determine local path for volume %s: %v", pv.Name, err)
+	}
+	storageClass, err := p.getClassForVolume(ctx, pv)
+	if err != nil {
+		return err
+	}
+	if storageClass.AllowVolumeExpansion == nil || !*storageClass.AllowVolumeExpansion {
+		return fmt.Errorf("storage class %s does not allow volume expansion", storageClass.Name)
+	}
+	enforcer := quotaEnforcerForBackend(storageClass.Parameters["quotaBackend"])
+	if _, isNoop := enforcer.(noopQuotaEnforcer); isNoop {
+		return fmt.Errorf("storage class %s has no quotaBackend configured, cannot enforce expansion", storageClass.Name)
+	}
+
+	projectID, err := p.projectIDIndex.Assign(path)
+	if err != nil {
+		return fmt.Errorf("unable to assign project id for %s: %v", path, err)
+	}
+	return enforcer.SetQuota(path, projectID, newSize.Value())
+}
+
+// reconcileQuotasAtStartup re-applies quotas for every PV this provisioner owns, recovering
+// any project quotas lost to a crash between Provision and the quota exec calls it makes.
+func (p *subdirProvisioner) reconcileQuotasAtStartup(ctx context.Context) {
+	pvs, err := p.client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("quota reconciler: unable to list PVs: %v", err)
+		return
+	}
+	sizesByBackend := map[string]map[string]int64{}
+	for _, pv := range pvs.Items {
+		if pv.Annotations[provisionedByAnnotation] != p.provisionerName {
+			continue
+		}
+		path, err := p.backend.LocalPath(pv.Spec.PersistentVolumeSource)
+		if err != nil {
+			continue
+		}
+		storageClass, err := p.getClassForVolume(ctx, &pv)
+		if err != nil {
+			glog.Warningf("quota reconciler: unable to get storage class for %s: %v", pv.Name, err)
+			continue
+		}
+		quotaBackend := storageClass.Parameters["quotaBackend"]
+		capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]
+		if !ok {
+			continue
+		}
+		if sizesByBackend[quotaBackend] == nil {
+			sizesByBackend[quotaBackend] = map[string]int64{}
+		}
+		sizesByBackend[quotaBackend][path] = capacity.Value()
+	}
+	for quotaBackend, sizes := range sizesByBackend {
+		reconcileQuotas(p.projectIDIndex, quotaEnforcerForBackend(quotaBackend), sizes)
+	}
 }
 
 // getClassForVolume returns StorageClass.
-func (p *nfsProvisioner) getClassForVolume(ctx context.Context, pv *v1.PersistentVolume) (*storage.StorageClass, error) {
+func (p *subdirProvisioner) getClassForVolume(ctx context.Context, pv *v1.PersistentVolume) (*storage.StorageClass, error) {
 	if p.client == nil {
 		return nil, fmt.Errorf("cannot get kube client")
 	}
@@ -279,16 +407,17 @@ func getIdFromString(id string) (int, error) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "archive" {
+		runArchiveCLI(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 
-	server := os.Getenv("NFS_SERVER")
-	if server == "" {
-		glog.Fatal("NFS_SERVER not set")
-	}
-	path := os.Getenv("NFS_PATH")
-	if path == "" {
-		glog.Fatal("NFS_PATH not set")
+	backend, err := backendFromEnv()
+	if err != nil {
+		glog.Fatalf("unable to configure backend: %v", err)
 	}
 	provisionerName := os.Getenv(provisionerNameKey)
 	if provisionerName == "" {
@@ -347,19 +476,64 @@ func main() {
 		}
 	}
 
-	clientNFSProvisioner := &nfsProvisioner{
-		client:      clientset,
-		server:      server,
-		path:        path,
-		defaultMode: mode,
-		defaultUid:  uid,
-		defaultGid:  gid,
+	clientProvisioner := &subdirProvisioner{
+		client:          clientset,
+		provisionerName: provisionerName,
+		backend:         backend,
+		defaultMode:     mode,
+		defaultUid:      uid,
+		defaultGid:      gid,
+		gidAllocator:    newGidAllocator(clientset, provisionerName),
+		projectIDIndex:  newProjectIDIndex(mountPath),
+	}
+	clientProvisioner.reconcileQuotasAtStartup(context.Background())
+
+	resizeScanInterval := defaultResizeScanInterval
+	if v := os.Getenv("RESIZE_SCAN_INTERVAL"); v != "" {
+		resizeScanInterval, err = time.ParseDuration(v)
+		if err != nil {
+			glog.Fatalf("Unable to parse RESIZE_SCAN_INTERVAL: %v", err)
+		}
+	}
+	resizeCtrl := newResizeController(clientset, provisionerName, clientProvisioner, resizeScanInterval)
+	go resizeCtrl.Run(context.Background())
+
+	metricsScanInterval := defaultMetricsScanInterval
+	if v := os.Getenv("METRICS_SCAN_INTERVAL"); v != "" {
+		metricsScanInterval, err = time.ParseDuration(v)
+		if err != nil {
+			glog.Fatalf("Unable to parse METRICS_SCAN_INTERVAL: %v", err)
+		}
+	}
+	metricsPort := os.Getenv("METRICS_PORT")
+	if metricsPort == "" {
+		metricsPort = defaultMetricsPort
+	}
+	collector := newMetricsCollector(clientset, provisionerName, backend, metricsScanInterval, defaultMetricsConcurrency)
+	go collector.Run(context.Background())
+	startMetricsServer(":" + metricsPort)
+
+	archiveGCInterval := defaultArchiveGCInterval
+	if v := os.Getenv("ARCHIVE_GC_INTERVAL"); v != "" {
+		archiveGCInterval, err = time.ParseDuration(v)
+		if err != nil {
+			glog.Fatalf("Unable to parse ARCHIVE_GC_INTERVAL: %v", err)
+		}
 	}
-	// Start the provision controller which will dynamically provision efs NFS
-	// PVs
+	var archiveDefaultRetention time.Duration
+	if v := os.Getenv("ARCHIVE_GC_DEFAULT_RETENTION"); v != "" {
+		archiveDefaultRetention, err = time.ParseDuration(v)
+		if err != nil {
+			glog.Fatalf("Unable to parse ARCHIVE_GC_DEFAULT_RETENTION: %v", err)
+		}
+	}
+	go runArchiveGC(archiveGCInterval, archiveDefaultRetention)
+
+	// Start the provision controller which will dynamically provision
+	// PVs backed by the configured backend
 	pc := controller.NewProvisionController(clientset,
 		provisionerName,
-		clientNFSProvisioner,
+		clientProvisioner,
 		serverVersion.GitVersion,
 		controller.LeaderElection(leaderElection),
 	)
@@ -0,0 +1,283 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// QuotaEnforcer raises the filesystem-level project quota backing a provisioned directory so
+// that `spec.resources.requests.storage` is actually enforced, not just recorded on the PV.
+type QuotaEnforcer interface {
+	// Name is the `quotaBackend` StorageClass parameter value this enforcer handles.
+	Name() string
+	// SetQuota sets the project quota for path, identified by projectID, to bytes.
+	SetQuota(path string, projectID int, bytes int64) error
+}
+
+// noopQuotaEnforcer is the default: directories stay unbounded, matching historical behavior.
+type noopQuotaEnforcer struct{}
+
+func (noopQuotaEnforcer) Name() string { return "noop" }
+
+func (noopQuotaEnforcer) SetQuota(path string, projectID int, bytes int64) error { return nil }
+
+// xfsQuotaEnforcer enforces quotas with XFS project quotas via the xfs_quota CLI. It requires
+// the backing export to be an XFS filesystem mounted with pquota/prjquota.
+type xfsQuotaEnforcer struct{}
+
+func (xfsQuotaEnforcer) Name() string { return "xfs_quota" }
+
+func (xfsQuotaEnforcer) SetQuota(path string, projectID int, bytes int64) error {
+	mountpoint, err := findMountpoint(path)
+	if err != nil {
+		return err
+	}
+	if err := runQuotaCmd("xfs_quota", "-x", "-c", fmt.Sprintf("project -s -p %s %d", path, projectID), mountpoint); err != nil {
+		return fmt.Errorf("unable to set xfs project %d on %s: %v", projectID, path, err)
+	}
+	if err := runQuotaCmd("xfs_quota", "-x", "-c", fmt.Sprintf("limit -p bhard=%d %d", bytes, projectID), mountpoint); err != nil {
+		return fmt.Errorf("unable to set xfs quota for project %d on %s: %v", projectID, mountpoint, err)
+	}
+	return nil
+}
+
+// linuxDqotEnforcer enforces quotas with ext4 project quotas via chattr/setquota. It requires
+// the backing export to be mounted with the prjquota option.
+type linuxDqotEnforcer struct{}
+
+func (linuxDqotEnforcer) Name() string { return "linux_dqot" }
+
+func (linuxDqotEnforcer) SetQuota(path string, projectID int, bytes int64) error {
+	mountpoint, err := findMountpoint(path)
+	if err != nil {
+		return err
+	}
+	if err := runQuotaCmd("chattr", "-p", strconv.Itoa(projectID), "+P", path); err != nil {
+		return fmt.Errorf("unable to set project id %d on %s: %v", projectID, path, err)
+	}
+	blocks := bytes / 1024
+	if err := runQuotaCmd("setquota", "-P", strconv.Itoa(projectID), "0", strconv.FormatInt(blocks, 10), "0", "0", mountpoint); err != nil {
+		return fmt.Errorf("unable to set quota for project %d on %s: %v", projectID, mountpoint, err)
+	}
+	return nil
+}
+
+func runQuotaCmd(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// findMountpoint returns the longest /proc/mounts entry that prefixes path, i.e. the mountpoint
+// actually backing it.
+func findMountpoint(path string) (string, error) {
+	f, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", fmt.Errorf("unable to read /proc/mounts: %v", err)
+	}
+	defer f.Close()
+
+	best := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mp := fields[1]
+		if strings.HasPrefix(path, mp) && len(mp) > len(best) {
+			best = mp
+		}
+	}
+	if best == "" {
+		return "", fmt.Errorf("no mountpoint found for %s", path)
+	}
+	return best, nil
+}
+
+func quotaEnforcerForBackend(backend string) QuotaEnforcer {
+	switch backend {
+	case "xfs_quota":
+		return xfsQuotaEnforcer{}
+	case "linux_dqot":
+		return linuxDqotEnforcer{}
+	default:
+		return noopQuotaEnforcer{}
+	}
+}
+
+// projectIDIndex is a small JSON-backed index mapping provisioned paths to the project IDs
+// assigned to them, so project IDs are stable across provisioner restarts and never reused
+// while a volume is live. It is protected by a file lock so concurrent provisioner processes
+// (e.g. during a rolling upgrade) don't hand out the same ID twice.
+type projectIDIndex struct {
+	indexPath string
+	lockPath  string
+
+	mutex sync.Mutex
+}
+
+type projectIDIndexData struct {
+	NextID   int            `json:"nextId"`
+	Projects map[string]int `json:"projects"`
+}
+
+func newProjectIDIndex(root string) *projectIDIndex {
+	return &projectIDIndex{
+		indexPath: filepath.Join(root, ".nfs-provisioner-project-ids.json"),
+		lockPath:  filepath.Join(root, ".nfs-provisioner-project-ids.lock"),
+	}
+}
+
+const firstProjectID = 100000
+
+// Assign returns the project ID for path, allocating and persisting a new one if path has
+// never been seen before.
+func (idx *projectIDIndex) Assign(path string) (int, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	unlock, err := idx.flock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	data, err := idx.load()
+	if err != nil {
+		return 0, err
+	}
+	if id, ok := data.Projects[path]; ok {
+		return id, nil
+	}
+	if data.NextID == 0 {
+		data.NextID = firstProjectID
+	}
+	id := data.NextID
+	data.Projects[path] = id
+	data.NextID = id + 1
+	if err := idx.save(data); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// All returns a copy of the path -> project ID index, for use by the quota reconciler.
+func (idx *projectIDIndex) All() (map[string]int, error) {
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	unlock, err := idx.flock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	data, err := idx.load()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]int, len(data.Projects))
+	for k, v := range data.Projects {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (idx *projectIDIndex) load() (*projectIDIndexData, error) {
+	data := &projectIDIndexData{Projects: map[string]int{}}
+	b, err := os.ReadFile(idx.indexPath)
+	if os.IsNotExist(err) {
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read project id index: %v", err)
+	}
+	if len(b) == 0 {
+		return data, nil
+	}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, fmt.Errorf("unable to parse project id index: %v", err)
+	}
+	if data.Projects == nil {
+		data.Projects = map[string]int{}
+	}
+	return data, nil
+}
+
+func (idx *projectIDIndex) save(data *projectIDIndexData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("unable to marshal project id index: %v", err)
+	}
+	if err := os.WriteFile(idx.indexPath, b, 0o600); err != nil {
+		return fmt.Errorf("unable to write project id index: %v", err)
+	}
+	return nil
+}
+
+func (idx *projectIDIndex) flock() (func(), error) {
+	f, err := os.OpenFile(idx.lockPath, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open project id index lock: %v", err)
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to lock project id index: %v", err)
+	}
+	return func() {
+		funlock(f)
+		f.Close()
+	}, nil
+}
+
+// reconcileQuotas re-applies the quota for every path in the project ID index. It is intended
+// to be run once at startup so quotas are restored after a crash, independently of the live
+// resize path that resizeController (resize.go) drives off PVC edits.
+func reconcileQuotas(idx *projectIDIndex, enforcer QuotaEnforcer, sizes map[string]int64) {
+	if _, ok := enforcer.(noopQuotaEnforcer); ok {
+		return
+	}
+	projects, err := idx.All()
+	if err != nil {
+		glog.Errorf("quota reconciler: unable to load project id index: %v", err)
+		return
+	}
+	for path, projectID := range projects {
+		bytes, ok := sizes[path]
+		if !ok {
+			continue
+		}
+		if err := enforcer.SetQuota(path, projectID, bytes); err != nil {
+			glog.Errorf("quota reconciler: unable to reapply quota for %s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	defaultResizeScanInterval = 30 * time.Second
+	defaultResizeConcurrency  = 2
+)
+
+// resizeController watches PVCs and drives subdirProvisioner.Resize when one is edited to
+// request more storage than its bound PV currently reports, since the annotation-based
+// sig-storage-lib controller this provisioner is built on has no ControllerExpandVolume-style
+// callback of its own to do this for us.
+type resizeController struct {
+	client          kubernetes.Interface
+	provisionerName string
+	provisioner     *subdirProvisioner
+	scanInterval    time.Duration
+
+	queue    workqueue.RateLimitingInterface
+	informer cache.SharedIndexInformer
+}
+
+func newResizeController(client kubernetes.Interface, provisionerName string, provisioner *subdirProvisioner, scanInterval time.Duration) *resizeController {
+	return &resizeController{
+		client:          client,
+		provisionerName: provisionerName,
+		provisioner:     provisioner,
+		scanInterval:    scanInterval,
+		queue:           workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+}
+
+// Run starts the PVC informer and the worker pool that reconciles pending expansions against it.
+// It blocks until ctx is done.
+func (c *resizeController) Run(ctx context.Context) {
+	factory := informers.NewSharedInformerFactory(c.client, c.scanInterval)
+	c.informer = factory.Core().V1().PersistentVolumeClaims().Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) { c.enqueue(newObj) },
+	})
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	for i := 0; i < defaultResizeConcurrency; i++ {
+		go c.runWorker(ctx)
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+}
+
+func (c *resizeController) enqueue(obj interface{}) {
+	pvc, ok := obj.(*v1.PersistentVolumeClaim)
+	if !ok || pvc.Status.Phase != v1.ClaimBound || pvc.Spec.VolumeName == "" {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(pvc)
+	if err != nil {
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *resizeController) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *resizeController) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.sync(ctx, key.(string)); err != nil {
+		glog.Errorf("resize: unable to reconcile pvc %s: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// sync compares a PVC's requested size against its bound PV's reported capacity, and grows the
+// PV's quota and Capacity to match when the PVC asked for more.
+func (c *resizeController) sync(ctx context.Context, key string) error {
+	obj, exists, err := c.informer.GetStore().GetByKey(key)
+	if err != nil || !exists {
+		return err
+	}
+	pvc := obj.(*v1.PersistentVolumeClaim)
+	if pvc.Spec.VolumeName == "" {
+		return nil
+	}
+
+	pv, err := c.client.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to get pv %s: %v", pvc.Spec.VolumeName, err)
+	}
+	if pv.Annotations[provisionedByAnnotation] != c.provisionerName {
+		return nil
+	}
+
+	requested := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+	capacity := pv.Spec.Capacity[v1.ResourceStorage]
+	if requested.Cmp(capacity) <= 0 {
+		return nil
+	}
+
+	glog.V(4).Infof("resize: pvc %s requests %s, pv %s currently reports %s, expanding", key, requested.String(), pv.Name, capacity.String())
+	if err := c.provisioner.Resize(ctx, pv, requested); err != nil {
+		return fmt.Errorf("unable to resize pv %s: %v", pv.Name, err)
+	}
+
+	pv = pv.DeepCopy()
+	pv.Spec.Capacity[v1.ResourceStorage] = requested
+	if _, err := c.client.CoreV1().PersistentVolumes().Update(ctx, pv, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("unable to update pv %s capacity: %v", pv.Name, err)
+	}
+	return nil
+}
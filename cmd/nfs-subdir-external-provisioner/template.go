@@ -0,0 +1,200 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pvcMetadata carries every value a StorageClass's pathPattern (or any other templated
+// parameter) can reference when it's expanded for a given PVC.
+type pvcMetadata struct {
+	data        map[string]string
+	labels      map[string]string
+	annotations map[string]string
+
+	pvcUID       string
+	scName       string
+	scParameters map[string]string
+	nodeName     string
+}
+
+// templateToken matches a single ${...} placeholder; everything inside the braces is handed to
+// expand, which resolves either a dotted reference (${.PVC.name}) or a pipeline
+// (${hash .PVC.uid | trunc 8}).
+var templateToken = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// safeTemplateValue is the character set a template reference is allowed to expand to. It excludes
+// "/" so a label or annotation value can never introduce an extra path segment.
+var safeTemplateValue = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// stringParser expands every ${...} placeholder in str. If strict is true, a reference to a
+// label, annotation or parameter that isn't set is an error; otherwise it expands to "", matching
+// the provisioner's original, pre-strict-mode behavior.
+func (meta *pvcMetadata) stringParser(str string, strict bool) (string, error) {
+	var missing []string
+	for _, r := range templateToken.FindAllStringSubmatch(str, -1) {
+		expr := strings.TrimSpace(r[1])
+		val, ok, err := meta.expand(expr)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			missing = append(missing, expr)
+			val = ""
+		}
+		if err := sanitizeTemplateValue(expr, val); err != nil {
+			return "", err
+		}
+		str = strings.ReplaceAll(str, r[0], val)
+	}
+	if strict && len(missing) > 0 {
+		return "", fmt.Errorf("pathPatternStrict is set and %s is unset", strings.Join(missing, ", "))
+	}
+	return str, nil
+}
+
+// sanitizeTemplateValue rejects an expanded value that could escape the directory the
+// provisioner intended to create, e.g. a PVC annotation of "../../etc".
+func sanitizeTemplateValue(ref, val string) error {
+	if val == "" {
+		return nil
+	}
+	if strings.HasPrefix(val, "/") || strings.Contains(val, "..") {
+		return fmt.Errorf("template reference %q expands to %q, which looks like a path traversal attempt", ref, val)
+	}
+	if !safeTemplateValue.MatchString(val) {
+		return fmt.Errorf("template reference %q expands to %q, which contains characters outside [A-Za-z0-9._-]", ref, val)
+	}
+	return nil
+}
+
+// expand resolves a single placeholder's contents: either a bare dotted reference like
+// ".PVC.labels.team", or a "helper arg | helper arg" pipeline like "hash .PVC.uid | trunc 8".
+func (meta *pvcMetadata) expand(expr string) (value string, ok bool, err error) {
+	if strings.Contains(expr, "|") {
+		return meta.expandPipeline(expr)
+	}
+	return meta.lookup(expr)
+}
+
+// lookup resolves a dotted reference such as ".PVC.name", ".SC.parameters.foo", ".Node.name" or
+// ".Time.YYYY" against meta. ok is false when the reference is well-formed but unset, e.g. an
+// annotation that wasn't applied to this PVC.
+func (meta *pvcMetadata) lookup(ref string) (string, bool, error) {
+	// SplitN with a limit of 3: label/annotation keys are free to contain their own dots (e.g.
+	// the reverse-DNS prefixes this repo's own annotationPrefix convention uses), so only the
+	// first two dots are structural; everything after them is the literal key.
+	parts := strings.SplitN(strings.TrimPrefix(ref, "."), ".", 3)
+	if len(parts) < 2 {
+		return "", false, fmt.Errorf("invalid template reference %q", ref)
+	}
+	switch parts[0] {
+	case "PVC":
+		switch parts[1] {
+		case "name", "namespace":
+			v, exists := meta.data[parts[1]]
+			return v, exists && v != "", nil
+		case "uid":
+			return meta.pvcUID, meta.pvcUID != "", nil
+		case "labels":
+			if len(parts) != 3 {
+				return "", false, fmt.Errorf("invalid template reference %q", ref)
+			}
+			v, exists := meta.labels[parts[2]]
+			return v, exists, nil
+		case "annotations":
+			if len(parts) != 3 {
+				return "", false, fmt.Errorf("invalid template reference %q", ref)
+			}
+			v, exists := meta.annotations[parts[2]]
+			return v, exists, nil
+		default:
+			return "", false, fmt.Errorf("unknown template reference %q", ref)
+		}
+	case "SC":
+		switch parts[1] {
+		case "name":
+			return meta.scName, meta.scName != "", nil
+		case "parameters":
+			if len(parts) != 3 {
+				return "", false, fmt.Errorf("invalid template reference %q", ref)
+			}
+			v, exists := meta.scParameters[parts[2]]
+			return v, exists, nil
+		default:
+			return "", false, fmt.Errorf("unknown template reference %q", ref)
+		}
+	case "Node":
+		if parts[1] != "name" {
+			return "", false, fmt.Errorf("unknown template reference %q", ref)
+		}
+		return meta.nodeName, meta.nodeName != "", nil
+	case "Time":
+		now := time.Now()
+		switch parts[1] {
+		case "YYYY":
+			return now.Format("2006"), true, nil
+		case "MM":
+			return now.Format("01"), true, nil
+		case "DD":
+			return now.Format("02"), true, nil
+		default:
+			return "", false, fmt.Errorf("unknown template reference %q", ref)
+		}
+	default:
+		return "", false, fmt.Errorf("unknown template reference %q", ref)
+	}
+}
+
+// expandPipeline resolves a "hash <ref> | trunc <n>" expression: hash takes the sha256 hex digest
+// of <ref>'s value, and trunc shortens it to n characters. It exists so pathPattern can derive a
+// short, stable, non-identifying path component from something like a PVC uid.
+func (meta *pvcMetadata) expandPipeline(expr string) (string, bool, error) {
+	stages := strings.Split(expr, "|")
+	head := strings.Fields(strings.TrimSpace(stages[0]))
+	if len(head) != 2 || head[0] != "hash" {
+		return "", false, fmt.Errorf("unsupported template expression %q", expr)
+	}
+	value, ok, err := meta.lookup(head[1])
+	if err != nil || !ok {
+		return "", ok, err
+	}
+	sum := sha256.Sum256([]byte(value))
+	result := hex.EncodeToString(sum[:])
+
+	for _, stage := range stages[1:] {
+		fields := strings.Fields(strings.TrimSpace(stage))
+		if len(fields) != 2 || fields[0] != "trunc" {
+			return "", false, fmt.Errorf("unsupported template filter %q", stage)
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return "", false, fmt.Errorf("invalid trunc length %q: %v", fields[1], err)
+		}
+		if n >= 0 && n < len(result) {
+			result = result[:n]
+		}
+	}
+	return result, true, nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import "testing"
+
+func testMeta() *pvcMetadata {
+	return &pvcMetadata{
+		data: map[string]string{
+			"name":      "my-pvc",
+			"namespace": "my-ns",
+		},
+		labels:      map[string]string{"team": "payments"},
+		annotations: map[string]string{"k8s-sigs.io/nfs-directory-gid": "2000"},
+		pvcUID:      "abcd1234-ef56-7890-abcd-1234567890ab",
+		scName:      "nfs-client",
+		scParameters: map[string]string{
+			"archiveRetention": "72h",
+		},
+		nodeName: "node-1",
+	}
+}
+
+func TestStringParserExpandsKnownReferences(t *testing.T) {
+	meta := testMeta()
+	cases := map[string]string{
+		"${.PVC.name}":        "my-pvc",
+		"${.PVC.namespace}":   "my-ns",
+		"${.PVC.labels.team}": "payments",
+		"${.PVC.annotations.k8s-sigs.io/nfs-directory-gid}": "2000",
+		"${.SC.name}":                        "nfs-client",
+		"${.SC.parameters.archiveRetention}": "72h",
+		"${.Node.name}":                      "node-1",
+		"prefix-${.PVC.name}-suffix":         "prefix-my-pvc-suffix",
+	}
+	for pattern, want := range cases {
+		got, err := meta.stringParser(pattern, false)
+		if err != nil {
+			t.Errorf("stringParser(%q) returned error: %v", pattern, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("stringParser(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestStringParserMissingReferenceNonStrict(t *testing.T) {
+	meta := testMeta()
+	got, err := meta.stringParser("${.PVC.labels.missing}", false)
+	if err != nil {
+		t.Fatalf("stringParser: unexpected error: %v", err)
+	}
+	if got != "" {
+		t.Fatalf("stringParser with an unset reference = %q, want empty string", got)
+	}
+}
+
+func TestStringParserMissingReferenceStrict(t *testing.T) {
+	meta := testMeta()
+	if _, err := meta.stringParser("${.PVC.labels.missing}", true); err == nil {
+		t.Fatal("expected stringParser to error on an unset reference in strict mode")
+	}
+}
+
+func TestStringParserHashPipeline(t *testing.T) {
+	meta := testMeta()
+	got, err := meta.stringParser("${hash .PVC.uid | trunc 8}", false)
+	if err != nil {
+		t.Fatalf("stringParser: %v", err)
+	}
+	if len(got) != 8 {
+		t.Fatalf("expected an 8-character hash, got %q (len %d)", got, len(got))
+	}
+
+	again, err := meta.stringParser("${hash .PVC.uid | trunc 8}", false)
+	if err != nil {
+		t.Fatalf("stringParser: %v", err)
+	}
+	if again != got {
+		t.Fatalf("expected hash pipeline to be deterministic, got %q then %q", got, again)
+	}
+}
+
+func TestStringParserRejectsPathTraversal(t *testing.T) {
+	meta := testMeta()
+	meta.annotations["evil"] = "../../etc"
+	if _, err := meta.stringParser("${.PVC.annotations.evil}", false); err == nil {
+		t.Fatal("expected stringParser to reject a value containing \"..\"")
+	}
+}
+
+func TestSanitizeTemplateValue(t *testing.T) {
+	cases := []struct {
+		name    string
+		val     string
+		wantErr bool
+	}{
+		{name: "empty is fine", val: "", wantErr: false},
+		{name: "simple name is fine", val: "team-payments_01", wantErr: false},
+		{name: "absolute path rejected", val: "/etc/passwd", wantErr: true},
+		{name: "dot-dot rejected", val: "../escape", wantErr: true},
+		{name: "embedded slash rejected", val: "foo/bar", wantErr: true},
+		{name: "unsafe characters rejected", val: "foo;rm -rf", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := sanitizeTemplateValue("${.PVC.annotations.test}", c.val)
+			if (err != nil) != c.wantErr {
+				t.Errorf("sanitizeTemplateValue(%q) error = %v, wantErr %v", c.val, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestLookupUnknownReference(t *testing.T) {
+	meta := testMeta()
+	if _, _, err := meta.lookup(".Bogus.name"); err == nil {
+		t.Fatal("expected lookup to error on an unknown top-level reference")
+	}
+}